@@ -15,26 +15,97 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"go/ast"
 	"go/build"
+	"go/build/constraint"
 	"go/token"
 	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// Platform identifies a single (GOOS, GOARCH, build tags, cgo) combination to analyze a package
+// under. The zero value means "the host platform that this analyzer itself is running on": GOOS,
+// GOARCH, and BuildTags fall back to build.Default's when left unset, and CgoEnabled is a pointer
+// so that "not specified" (nil, inherit build.Default.CgoEnabled) is distinguishable from an
+// explicit request to disable cgo (false).
+type Platform struct {
+	GOOS       string   `json:",omitempty"`
+	GOARCH     string   `json:",omitempty"`
+	BuildTags  []string `json:",omitempty"`
+	CgoEnabled *bool    `json:",omitempty"`
+}
+
+// buildContextForPlatform returns a copy of build.Default with any fields set on platform
+// overridden, so that analyzePackage can be run once per requested platform.
+func buildContextForPlatform(platform Platform) *build.Context {
+	buildContext := build.Default
+	if platform.GOOS != "" {
+		buildContext.GOOS = platform.GOOS
+	}
+	if platform.GOARCH != "" {
+		buildContext.GOARCH = platform.GOARCH
+	}
+	if platform.CgoEnabled != nil {
+		buildContext.CgoEnabled = *platform.CgoEnabled
+	}
+	if len(platform.BuildTags) > 0 {
+		buildContext.BuildTags = platform.BuildTags
+	}
+	return &buildContext
+}
+
+// platformKey returns the string used to key a platform's Package result in the JSON object
+// emitted for each analyzed directory, e.g. "linux_amd64_cgo_bar+foo" (build tags are sorted). It must encode the full
+// (GOOS, GOARCH, BuildTags, CgoEnabled) tuple, not just GOOS/GOARCH, since two requested platforms
+// can share a GOOS/GOARCH pair and differ only in tags or cgo.
+func platformKey(buildContext *build.Context) string {
+	key := buildContext.GOOS + "_" + buildContext.GOARCH
+	if buildContext.CgoEnabled {
+		key += "_cgo"
+	}
+	if len(buildContext.BuildTags) > 0 {
+		tags := append([]string(nil), buildContext.BuildTags...)
+		sort.Strings(tags)
+		key += "_" + strings.Join(tags, "+")
+	}
+	return key
+}
+
 // Package represents the results of analyzing a Go package.
 type Package struct {
 	Name    string   // package name
 	AllTags []string `json:",omitempty"` // tags that can influence file selection in this directory
 
+	// BuildConstraints holds the raw //go:build (or +build) expression for every .go file in the
+	// directory that has one, keyed by file name. Unlike AllTags, which only records the union of
+	// tags seen for the current platform, this lets a caller re-evaluate a file's constraint
+	// against a hypothetical (GOOS, GOARCH, tags) tuple via EvaluateBuildConstraint, without a
+	// second sandboxed invocation of this analyzer.
+	BuildConstraints map[string]string `json:",omitempty"`
+
+	// BinaryOnly is true if the package is "binary-only", meaning that the only way to use it is
+	// to link against a precompiled object, as indicated by a `//go:binary-only-package` comment.
+	BinaryOnly bool `json:",omitempty"`
+
+	// ImportComment is the import path declared via a `// import "path"` comment on the package
+	// clause, if any. Source files that disagree on this are reported via InvalidGoFiles.
+	ImportComment string `json:",omitempty"`
+
 	// Source files
 	GoFiles           []string `json:",omitempty"` // .go source files (excluding CgoFiles, TestGoFiles, XTestGoFiles)
 	CgoFiles          []string `json:",omitempty"` // .go source files that import "C"
+	CompiledGoFiles   []string `json:",omitempty"` // .go files created by cgo preprocessing CgoFiles, only populated when requested
 	IgnoredGoFiles    []string `json:",omitempty"` // .go source files ignored for this build (including ignored _test.go files)
 	IgnoredOtherFiles []string `json:",omitempty"` // non-.go source files ignored for this build
 	CFiles            []string `json:",omitempty"` // .c source files
@@ -60,11 +131,24 @@ type Package struct {
 	XTestGoFiles []string `json:",omitempty"`
 
 	// Dependency information
-	// Note: This does not include the token position information for the imports.
 	Imports      []string `json:",omitempty"`
 	TestImports  []string `json:",omitempty"`
 	XTestImports []string `json:",omitempty"`
 
+	// CompiledGoFileImports holds every import found in CompiledGoFiles: the ones the CgoFiles
+	// already declared, plus those cgo itself injects when translating `import "C"` (e.g. "unsafe",
+	// "syscall", "runtime/cgo"). These are kept separate from Imports, which lists only what the
+	// original source declared, as Pants' dependency inference treats Imports as what the source
+	// actually asked for.
+	CompiledGoFileImports []string `json:",omitempty"`
+
+	// Positions of the imports above, keyed by import path. Unlike Imports/TestImports/XTestImports,
+	// these carry the file/line/column of each occurrence plus any doc comment attached to the
+	// import (e.g. a canonical import path override).
+	ImportPositions      map[string][]ImportPos `json:",omitempty"`
+	TestImportPositions  map[string][]ImportPos `json:",omitempty"`
+	XTestImportPositions map[string][]ImportPos `json:",omitempty"`
+
 	// //go:embed patterns found in Go source files
 	// For example, if a source file says
 	//	//go:embed a* b.c
@@ -79,6 +163,126 @@ type Package struct {
 	Error          string            `json:",omitempty"`
 }
 
+// ImportPos records where a single import appears in a source file, along with any doc comment
+// attached to it (e.g. `// import "canonical/path"`-style overrides).
+type ImportPos struct {
+	File string
+	Line int
+	Col  int
+	Doc  string `json:",omitempty"`
+}
+
+// findImportComment returns the import path declared via a `// import "path"` (or `/* import
+// "path" */`) comment trailing the package clause of a parsed file, or "" if there is none.
+func findImportComment(fileSet *token.FileSet, parsed *ast.File) string {
+	if parsed == nil || parsed.Name == nil {
+		return ""
+	}
+	namePos := fileSet.Position(parsed.Name.End())
+	for _, cg := range parsed.Comments {
+		if fileSet.Position(cg.Pos()).Line != namePos.Line {
+			continue
+		}
+		text := strings.TrimSpace(cg.Text())
+		rest := strings.TrimSpace(strings.TrimPrefix(text, "import"))
+		if rest == text {
+			continue
+		}
+		path, err := strconv.Unquote(rest)
+		if err != nil {
+			continue
+		}
+		return path
+	}
+	return ""
+}
+
+// readBuildConstraint extracts the raw //go:build expression from a Go source file's leading
+// comments, preferring it over any // +build lines per the rules in go/build/constraint. It
+// returns "" if the file has no build constraint at all.
+func readBuildConstraint(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var expr constraint.Expr
+	sawGoBuild := false
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "":
+			continue
+		case constraint.IsGoBuild(line):
+			e, err := constraint.Parse(line)
+			if err != nil {
+				return "", fmt.Errorf("%s: %s", filename, err)
+			}
+			expr, sawGoBuild = e, true
+		case constraint.IsPlusBuild(line):
+			if sawGoBuild {
+				continue
+			}
+			e, err := constraint.Parse(line)
+			if err != nil {
+				return "", fmt.Errorf("%s: %s", filename, err)
+			}
+			if expr == nil {
+				expr = e
+			} else {
+				expr = &constraint.AndExpr{X: expr, Y: e}
+			}
+		case strings.HasPrefix(line, "//"):
+			continue
+		case strings.HasPrefix(line, "package"):
+			// The package clause ends the run of leading comments that build constraints may appear in.
+			return exprString(expr), nil
+		default:
+			return exprString(expr), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return exprString(expr), nil
+}
+
+func exprString(expr constraint.Expr) string {
+	if expr == nil {
+		return ""
+	}
+	return expr.String()
+}
+
+// EvaluateBuildConstraint parses a raw //go:build expression, as stored in Package.BuildConstraints,
+// and evaluates it against an arbitrary (GOOS, GOARCH, tags) tuple without needing to re-read the
+// source file the expression came from. Tag matching is delegated to matchAuto, the same helper
+// matchFile uses to decide whether a file's own constraint is satisfied, so implicit tags like
+// "unix" and the "goN.M" release-version ladder are handled identically here and there.
+func EvaluateBuildConstraint(rawExpr string, goos string, goarch string, tags []string) (bool, error) {
+	if rawExpr == "" {
+		return true, nil
+	}
+
+	// rawExpr is the bare boolean expression as produced by exprString (expr.String()), not a
+	// "//go:build ..." line, so it must be re-prefixed before constraint.Parse will accept it.
+	expr, err := constraint.Parse("//go:build " + rawExpr)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse build constraint %q: %s", rawExpr, err)
+	}
+
+	buildContext := build.Default
+	buildContext.GOOS = goos
+	buildContext.GOARCH = goarch
+	buildContext.BuildTags = tags
+
+	return expr.Eval(func(tag string) bool { return matchAuto(&buildContext, tag, nil) }), nil
+}
+
 func analyzeFile(fileSet *token.FileSet, filename string) (*fileInfo, error) {
 	fi := fileInfo{filename: filename, fset: fileSet}
 
@@ -208,9 +412,207 @@ func saveCgo(filename string, pkg *Package, cg *ast.CommentGroup, buildContext *
 	return nil
 }
 
-func analyzePackage(directory string, buildContext *build.Context) (*Package, error) {
+// findCgoTool locates the `cgo` binary to use for the given build context, preferring the copy
+// shipped under GOROOT before falling back to $PATH. Unlike the compiled output, which is built
+// for buildContext's target GOOS/GOARCH, cgo (like compile and link) is a host-native binary: a
+// stock Go install only ships a pkg/tool/<host GOOS>_<host GOARCH>/ directory, so the tool must
+// always be located by the host's runtime.GOOS/GOARCH regardless of what platform is being
+// cross-compiled for. See go/build's getToolDir for the same convention.
+func findCgoTool(buildContext *build.Context) (string, error) {
+	goroot := buildContext.GOROOT
+	if goroot == "" {
+		goroot = runtime.GOROOT()
+	}
+	candidate := filepath.Join(goroot, "pkg", "tool", runtime.GOOS+"_"+runtime.GOARCH, "cgo")
+	if _, err := os.Stat(candidate); err == nil {
+		return candidate, nil
+	}
+	return exec.LookPath("cgo")
+}
+
+// pendingCgoObjDirs tracks the temp directories created by runCgoPreprocessing that have not yet
+// been reaped. In --stdin mode this process stays alive across many packages, so callers must
+// invoke reapPendingCgoObjDirs once a result has been consumed (e.g. before starting the next
+// package) to avoid leaking one temp directory per cgo package for the life of the process.
+var (
+	pendingCgoObjDirsMu sync.Mutex
+	pendingCgoObjDirs   []string
+)
+
+// reapPendingCgoObjDirs removes the temp directories created by cgo preprocessing since the last
+// call, and forgets them. It is safe to call once the CompiledGoFiles paths they contain have
+// already been consumed downstream.
+func reapPendingCgoObjDirs() {
+	pendingCgoObjDirsMu.Lock()
+	dirs := pendingCgoObjDirs
+	pendingCgoObjDirs = nil
+	pendingCgoObjDirsMu.Unlock()
+
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+	}
+}
+
+// runCgoPreprocessing invokes the `cgo` tool on a package's CgoFiles, translating the `import "C"`
+// files into the plain Go sources the compiler actually sees (cgo's `_cgo_gotypes.go`, `*.cgo1.go`,
+// etc). This mirrors the CgoFiles/CompiledGoFiles split that `cmd/go` uses: CgoFiles remain the cgo
+// inputs, and the returned paths are the post-cgo Go sources. The generated files are left in a
+// temporary directory tracked in pendingCgoObjDirs, for a caller to reap once consumed via
+// reapPendingCgoObjDirs.
+func runCgoPreprocessing(directory string, cgoFiles []string, buildContext *build.Context) ([]string, error) {
+	cgoTool, err := findCgoTool(buildContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate cgo tool: %s", err)
+	}
+
+	objDir, err := os.MkdirTemp("", "pants-cgo-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory for cgo output: %s", err)
+	}
+	pendingCgoObjDirsMu.Lock()
+	pendingCgoObjDirs = append(pendingCgoObjDirs, objDir)
+	pendingCgoObjDirsMu.Unlock()
+
+	args := []string{"-objdir", objDir}
+	for _, name := range cgoFiles {
+		args = append(args, filepath.Join(directory, name))
+	}
+
+	cmd := exec.Command(cgoTool, args...)
+	cmd.Dir = directory
+	cmd.Env = append(os.Environ(), "GOOS="+buildContext.GOOS, "GOARCH="+buildContext.GOARCH)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("cgo failed: %s\n%s", err, output)
+	}
+
+	entries, err := os.ReadDir(objDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cgo output directory: %s", err)
+	}
+
+	var compiledGoFiles []string
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".go" {
+			continue
+		}
+		compiledGoFiles = append(compiledGoFiles, filepath.Join(objDir, entry.Name()))
+	}
+	sort.Strings(compiledGoFiles)
+	return compiledGoFiles, nil
+}
+
+// fileAnalysisResult holds the outcome of running matchFile (and, for matched .go files,
+// analyzeFile) on a single directory entry.
+type fileAnalysisResult struct {
+	name  string
+	ext   string
+	isDir bool
+
+	statErr error
+
+	matched    *fileInfo
+	matchErr   error
+	binaryOnly bool
+
+	analysis    *fileInfo
+	analysisErr error
+
+	buildConstraint    string
+	buildConstraintErr error
+}
+
+// analyzeEntry runs readBuildConstraint on a .go file whether or not it matches, then matchFile
+// and, if it matches a .go file, analyzeFile for a single directory entry. matchFile is given a local tags map so its parsing runs unlocked;
+// allTagsMu is only held long enough to merge that local map into the shared allTags afterward.
+func analyzeEntry(directory string, entry fs.DirEntry, buildContext *build.Context, allTags map[string]bool, allTagsMu *sync.Mutex, fileSet *token.FileSet) fileAnalysisResult {
+	name := entry.Name()
+	result := fileAnalysisResult{name: name, ext: filepath.Ext(name)}
+
+	if entry.IsDir() {
+		result.isDir = true
+		return result
+	}
+
+	if entry.Type()&fs.ModeSymlink != 0 {
+		linkFullPath := filepath.Join(directory, name)
+		linkStat, err := os.Stat(linkFullPath)
+		if err != nil {
+			result.statErr = err
+			return result
+		}
+		if linkStat.IsDir() {
+			result.isDir = true
+			return result
+		}
+	}
+
+	if result.ext == ".go" && !strings.HasPrefix(name, "_") && !strings.HasPrefix(name, ".") {
+		result.buildConstraint, result.buildConstraintErr = readBuildConstraint(filepath.Join(directory, name))
+	}
+
+	// TODO: `MatchFile` will actually parse the imports but does not return the AST. Consider vendoring
+	// the MatchFile logic to avoid double parsing.
+	localTags := make(map[string]bool)
+	matched, err := matchFile(buildContext, directory, name, localTags, &result.binaryOnly, fileSet)
+	result.matched = matched
+	result.matchErr = err
+
+	allTagsMu.Lock()
+	for tag := range localTags {
+		allTags[tag] = true
+	}
+	allTagsMu.Unlock()
+
+	if err == nil && matched != nil && result.ext == ".go" {
+		result.analysis, result.analysisErr = analyzeFile(fileSet, filepath.Join(directory, name))
+	}
+
+	return result
+}
+
+// matchAndAnalyzeFiles runs analyzeEntry for every entry, using a pool of jobs workers. Workers
+// share a single token.FileSet (safe for concurrent use by multiple goroutines); each worker's call
+// into matchFile uses its own local tags map so the parsing matchFile does is unlocked and runs in
+// parallel, only taking allTagsMu briefly afterward to merge into the shared allTags. Results are
+// returned in the same order as entries so that callers see deterministic behavior regardless of
+// scheduling.
+func matchAndAnalyzeFiles(directory string, entries []fs.DirEntry, buildContext *build.Context, allTags map[string]bool, fileSet *token.FileSet, jobs int) []fileAnalysisResult {
+	results := make([]fileAnalysisResult, len(entries))
+
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	var allTagsMu sync.Mutex
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	wg.Add(jobs)
+	for w := 0; w < jobs; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = analyzeEntry(directory, entries[i], buildContext, allTags, &allTagsMu, fileSet)
+			}
+		}()
+	}
+	for i := range entries {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return results
+}
+
+// analyzePackage analyzes the Go source files in directory. expectedImportPath, if non-empty, is
+// checked against any `// import "path"` comment found on the package clause, matching `go build`'s
+// behavior of refusing to build a source file whose import comment disagrees with the path it was
+// imported under. jobs caps the number of files analyzed concurrently.
+func analyzePackage(directory string, buildContext *build.Context, expectedImportPath string, compileCgo bool, jobs int) (*Package, error) {
 	pkg := &Package{
-		InvalidGoFiles: make(map[string]string),
+		InvalidGoFiles:   make(map[string]string),
+		BuildConstraints: make(map[string]string),
 	}
 
 	fileSet := token.NewFileSet()
@@ -223,10 +625,18 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 	// Keep track of the names used in `package` directives to ensure that only one package name is used.
 	packageNames := make(map[string]bool)
 
+	// Keep track of the file that first set pkg.ImportComment, to produce a useful error message if
+	// a later file disagrees.
+	importCommentFile := ""
+
 	importsMap := make(map[string]bool)
 	testImportsMap := make(map[string]bool)
 	xtestImportsMap := make(map[string]bool)
 
+	importPositions := make(map[string][]ImportPos)
+	testImportPositions := make(map[string][]ImportPos)
+	xtestImportPositions := make(map[string][]ImportPos)
+
 	embedsMap := make(map[string]bool)
 	testEmbedsMap := make(map[string]bool)
 	xtestEmbedsMap := make(map[string]bool)
@@ -235,34 +645,30 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 
 	var cgoSfiles []string // files with ".S"(capital S)/.sx(capital s equivalent for case insensitive filesystems)
 
-	for _, entry := range entries {
-		if entry.IsDir() {
+	results := matchAndAnalyzeFiles(directory, entries, buildContext, allTags, fileSet, jobs)
+
+	for _, result := range results {
+		if result.isDir {
 			continue
 		}
 
-		name := entry.Name()
-		ext := filepath.Ext(name)
+		name := result.name
+		ext := result.ext
 
-		if entry.Type()&fs.ModeSymlink != 0 {
-			linkFullPath := filepath.Join(directory, name)
-			linkStat, err := os.Stat(linkFullPath)
-			if err != nil {
-				// TODO: Report this error?
-				continue
-			}
-			if linkStat.IsDir() {
-				continue
-			}
+		if result.statErr != nil {
+			// TODO: Report this error?
+			continue
 		}
 
-		// TODO: `MatchFile` will actually parse the imports but does not return the AST. Consider vendoring
-		// the MatchFile logic to avoid double parsing.
-		binaryOnly := false
-		fileInfo, err := matchFile(buildContext, directory, name, allTags, &binaryOnly, fileSet)
-		if err != nil {
-			pkg.InvalidGoFiles[name] = err.Error()
+		if result.buildConstraintErr == nil && result.buildConstraint != "" {
+			pkg.BuildConstraints[name] = result.buildConstraint
+		}
+
+		if result.matchErr != nil {
+			pkg.InvalidGoFiles[name] = result.matchErr.Error()
 			continue
 		}
+		fileInfo := result.matched
 		if fileInfo == nil {
 			if strings.HasPrefix(name, "_") || strings.HasPrefix(name, ".") {
 				// `go` ignores files prefixed with underscore or period. Since this is not due to
@@ -275,6 +681,10 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 			continue
 		}
 
+		if result.binaryOnly {
+			pkg.BinaryOnly = true
+		}
+
 		// Going to save the file. For non-Go files, can stop here.
 		switch ext {
 		case ".go":
@@ -290,7 +700,7 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 			continue
 		}
 
-		analysis, err := analyzeFile(fileSet, filepath.Join(directory, name))
+		analysis, err := result.analysis, result.analysisErr
 		if err != nil {
 			pkg.InvalidGoFiles[name] = err.Error()
 			// Fall-through to allow still listing the file's existence.
@@ -319,8 +729,26 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 		}
 		packageNames[pkgName] = true
 
-		// TODO: Handle import comments?
-		// See https://cs.opensource.google/go/go/+/refs/tags/go1.17.2:src/go/build/build.go;drc=refs%2Ftags%2Fgo1.17.2;l=920
+		if analysis != nil {
+			if importComment := findImportComment(fileSet, analysis.parsed); importComment != "" {
+				if pkg.ImportComment == "" {
+					pkg.ImportComment = importComment
+					importCommentFile = name
+				} else if importComment != pkg.ImportComment {
+					pkg.InvalidGoFiles[name] = fmt.Sprintf(
+						"found import comments %q (%s) and %q (%s) in %s",
+						pkg.ImportComment, importCommentFile, importComment, name, directory,
+					)
+					continue
+				}
+				if expectedImportPath != "" && importComment != expectedImportPath {
+					pkg.InvalidGoFiles[name] = fmt.Sprintf(
+						"code in directory %s expects import %q", directory, expectedImportPath,
+					)
+					continue
+				}
+			}
+		}
 
 		// Check whether CGo is in use.
 		isCGo := false
@@ -343,6 +771,7 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 		var fileList *[]string
 		var embedsMapForFile map[string]bool
 		var importsMapForFile map[string]bool
+		var importPositionsForFile map[string][]ImportPos
 
 		switch {
 		case isCGo:
@@ -350,6 +779,7 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 			if buildContext.CgoEnabled {
 				fileList = &pkg.CgoFiles
 				importsMapForFile = importsMap
+				importPositionsForFile = importPositions
 				embedsMapForFile = embedsMap
 			} else {
 				// Ignore imports and embeds from cgo files if cgo is disabled.
@@ -358,14 +788,17 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 		case isXTest:
 			fileList = &pkg.XTestGoFiles
 			importsMapForFile = xtestImportsMap
+			importPositionsForFile = xtestImportPositions
 			embedsMapForFile = xtestEmbedsMap
 		case isTest:
 			fileList = &pkg.TestGoFiles
 			importsMapForFile = testImportsMap
+			importPositionsForFile = testImportPositions
 			embedsMapForFile = testEmbedsMap
 		default:
 			fileList = &pkg.GoFiles
 			importsMapForFile = importsMap
+			importPositionsForFile = importPositions
 			embedsMapForFile = embedsMap
 		}
 
@@ -374,6 +807,18 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 		if importsMapForFile != nil && analysis != nil {
 			for _, importPath := range analysis.imports {
 				importsMapForFile[importPath.path] = true
+
+				pos := fileSet.Position(importPath.pos)
+				var doc string
+				if importPath.doc != nil {
+					doc = strings.TrimSpace(importPath.doc.Text())
+				}
+				importPositionsForFile[importPath.path] = append(importPositionsForFile[importPath.path], ImportPos{
+					File: filepath.Base(pos.Filename),
+					Line: pos.Line,
+					Col:  pos.Column,
+					Doc:  doc,
+				})
 			}
 		}
 
@@ -386,10 +831,38 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 
 	pkg.AllTags = cleanStringSet(allTags)
 
+	if compileCgo && len(pkg.CgoFiles) > 0 {
+		compiledGoFiles, err := runCgoPreprocessing(directory, pkg.CgoFiles, buildContext)
+		if err != nil {
+			return pkg, fmt.Errorf("failed to run cgo preprocessing in %s: %s", directory, err)
+		}
+		pkg.CompiledGoFiles = compiledGoFiles
+
+		// These imports include cgo's own synthetic additions (e.g. "unsafe", "runtime/cgo") on top
+		// of what the original source declared, so they are tracked separately from Imports.
+		compiledGoFileImportsMap := make(map[string]bool)
+		for _, compiledFile := range compiledGoFiles {
+			analysis, err := analyzeFile(fileSet, compiledFile)
+			if err != nil || analysis.parseErr != nil {
+				// Generated files are not expected to fail to parse; skip extracting their imports
+				// rather than failing the whole analysis over tool-generated code.
+				continue
+			}
+			for _, imp := range analysis.imports {
+				compiledGoFileImportsMap[imp.path] = true
+			}
+		}
+		pkg.CompiledGoFileImports = cleanStringSet(compiledGoFileImportsMap)
+	}
+
 	pkg.Imports = cleanStringSet(importsMap)
 	pkg.TestImports = cleanStringSet(testImportsMap)
 	pkg.XTestImports = cleanStringSet(xtestImportsMap)
 
+	pkg.ImportPositions = importPositions
+	pkg.TestImportPositions = testImportPositions
+	pkg.XTestImportPositions = xtestImportPositions
+
 	pkg.EmbedPatterns = cleanStringSet(embedsMap)
 	pkg.TestEmbedPatterns = cleanStringSet(testEmbedsMap)
 	pkg.XTestEmbedPatterns = cleanStringSet(xtestEmbedsMap)
@@ -423,13 +896,56 @@ func analyzePackage(directory string, buildContext *build.Context) (*Package, er
 	return pkg, nil
 }
 
-func main() {
-	// TODO: Consider allowing caller to set build tags or platform? Setting platform GOOS/GOARCH will be
-	// necessary for multi-platform support.
-	buildContext := &build.Default
+// loadPlatforms reads the JSON array of Platform values from path. An empty path means "analyze
+// only the host platform", matching the tool's previous, single-platform behavior.
+func loadPlatforms(path string) ([]Platform, error) {
+	if path == "" {
+		return []Platform{{}}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read platforms file %s: %s", path, err)
+	}
+
+	var platforms []Platform
+	if err := json.Unmarshal(data, &platforms); err != nil {
+		return nil, fmt.Errorf("failed to parse platforms file %s: %s", path, err)
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("platforms file %s must contain at least one platform", path)
+	}
+	return platforms, nil
+}
+
+// splitDirArg splits a positional CLI argument of the form "directory" or "directory=import/path"
+// into the directory to analyze and the import path its files are expected to declare via a
+// `// import "path"` comment, if any.
+func splitDirArg(arg string) (directory string, expectedImportPath string) {
+	if directory, expectedImportPath, ok := strings.Cut(arg, "="); ok {
+		return directory, expectedImportPath
+	}
+	return arg, ""
+}
+
+// analyzeForPlatforms runs analyzePackage once per platform and returns the results keyed by
+// platformKey, so that a single sandboxed invocation can cover every platform Pants cares about.
+// It is an error for two requested platforms to resolve to the same key, since that would mean one
+// platform's result silently overwrites another's.
+func analyzeForPlatforms(directory string, expectedImportPath string, platforms []Platform, compileCgo bool, jobs int) (map[string]*Package, error) {
+	results := make(map[string]*Package, len(platforms))
+	for _, platform := range platforms {
+		buildContext := buildContextForPlatform(platform)
+
+		key := platformKey(buildContext)
+		if _, exists := results[key]; exists {
+			return nil, fmt.Errorf(
+				"duplicate platform %q: requested platforms must have distinct (GOOS, GOARCH, BuildTags, CgoEnabled) tuples",
+				key,
+			)
+		}
 
-	for _, arg := range os.Args[1:] {
-		pkg, err := analyzePackage(arg, buildContext)
+		pkg, err := analyzePackage(directory, buildContext, expectedImportPath, compileCgo, jobs)
 		if err != nil {
 			pkg.Error = err.Error()
 		}
@@ -437,16 +953,141 @@ func main() {
 			pkg.Error = "invalid Go sources encountered"
 		}
 
-		outputBytes, err := json.Marshal(pkg)
-		if err != nil {
-			fmt.Printf("{\"Error\": \"Failed to encode package metadata: %s\"}", err)
-			continue
+		results[key] = pkg
+	}
+	return results, nil
+}
+
+// constraintQuery is a --stdin request asking whether a raw //go:build expression, as previously
+// reported in Package.BuildConstraints, matches a hypothetical (GOOS, GOARCH, tags) tuple. A line
+// in --stdin mode starting with "?" is parsed as the JSON encoding of one of these instead of a
+// directory to analyze.
+type constraintQuery struct {
+	Expr   string
+	GOOS   string
+	GOARCH string
+	Tags   []string `json:",omitempty"`
+}
+
+// constraintQueryResult is the JSON written back for a constraintQuery.
+type constraintQueryResult struct {
+	Matches bool   `json:",omitempty"`
+	Error   string `json:",omitempty"`
+}
+
+// evaluateConstraintQuery decodes and answers a single constraintQuery line, returning the
+// JSON-encoded result ready to be written out as one line of --stdin output.
+func evaluateConstraintQuery(raw string) []byte {
+	var query constraintQuery
+	if err := json.Unmarshal([]byte(raw), &query); err != nil {
+		return []byte(fmt.Sprintf("{\"Error\": %q}", fmt.Sprintf("failed to parse constraint query: %s", err)))
+	}
+
+	matches, err := EvaluateBuildConstraint(query.Expr, query.GOOS, query.GOARCH, query.Tags)
+	result := constraintQueryResult{Matches: matches}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	outputBytes, err := json.Marshal(result)
+	if err != nil {
+		return []byte(fmt.Sprintf("{\"Error\": \"failed to encode constraint query result: %s\"}", err))
+	}
+	return outputBytes
+}
+
+// analyzeArg analyzes the directory named by a single CLI (or --stdin) argument across platforms
+// and returns the JSON-encoded result, ready to be written out as one line of output.
+func analyzeArg(arg string, platforms []Platform, compileCgo bool, jobs int) []byte {
+	directory, expectedImportPath := splitDirArg(arg)
+	results, err := analyzeForPlatforms(directory, expectedImportPath, platforms, compileCgo, jobs)
+	if err != nil {
+		return []byte(fmt.Sprintf("{\"Error\": %q}", err.Error()))
+	}
+
+	outputBytes, err := json.Marshal(results)
+	if err != nil {
+		return []byte(fmt.Sprintf("{\"Error\": \"Failed to encode package metadata: %s\"}", err))
+	}
+	return outputBytes
+}
+
+func main() {
+	platformsFile := flag.String(
+		"platforms",
+		"",
+		"path to a JSON file containing an array of platform tuples (GOOS, GOARCH, BuildTags, CgoEnabled) "+
+			"to analyze each package for; defaults to only the host platform",
+	)
+	compiled := flag.Bool(
+		"compiled",
+		false,
+		"run cgo preprocessing on CgoFiles and populate CompiledGoFiles with the generated plain Go sources",
+	)
+	jobs := flag.Int(
+		"jobs",
+		runtime.NumCPU(),
+		"maximum number of files to analyze concurrently within a single package",
+	)
+	stdinMode := flag.Bool(
+		"stdin",
+		false,
+		"read newline-delimited directory paths from stdin and write one JSON result per line to "+
+			"stdout, instead of taking directories as positional arguments; keeps the process alive "+
+			"across many packages so Go runtime startup and the build context are amortized. A line "+
+			"starting with \"?\" is instead treated as the JSON encoding of a constraintQuery, asking "+
+			"whether a raw //go:build expression matches a given (GOOS, GOARCH, tags) tuple",
+	)
+	flag.Parse()
+
+	platforms, err := loadPlatforms(*platformsFile)
+	if err != nil {
+		fmt.Printf("{\"Error\": %q}", err.Error())
+		os.Exit(1)
+	}
+
+	if *stdinMode {
+		scanner := bufio.NewScanner(os.Stdin)
+		writer := bufio.NewWriter(os.Stdout)
+		for scanner.Scan() {
+			arg := strings.TrimSpace(scanner.Text())
+			if arg == "" {
+				continue
+			}
+
+			var output []byte
+			if query, ok := strings.CutPrefix(arg, "?"); ok {
+				output = evaluateConstraintQuery(query)
+			} else {
+				// Reap the previous package's cgo temp directories. This is only safe because the
+				// caller reads one response per request before sending the next line, so whatever we
+				// wrote last iteration has already been consumed.
+				reapPendingCgoObjDirs()
+				output = analyzeArg(arg, platforms, *compiled, *jobs)
+			}
+
+			writer.Write(output)
+			writer.WriteByte('\n')
+			writer.Flush()
 		}
-		_, err = os.Stdout.Write(outputBytes)
+		reapPendingCgoObjDirs()
+		if err := scanner.Err(); err != nil {
+			fmt.Printf("{\"Error\": \"Failed to read stdin: %s\"}", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	for _, arg := range flag.Args() {
+		_, err := os.Stdout.Write(analyzeArg(arg, platforms, *compiled, *jobs))
 		if err != nil {
 			fmt.Printf("{\"Error\": \"Failed to write package metadata: %s\"}", err)
 			continue
 		}
+		// As in --stdin mode, reap this package's cgo temp directories now that its output has been
+		// written; otherwise a single-shot --compiled invocation (the common case, since this process
+		// exits right after) would leak one temp directory per cgo package forever.
+		reapPendingCgoObjDirs()
 	}
 
 	os.Exit(0)
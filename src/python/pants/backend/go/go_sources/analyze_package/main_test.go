@@ -0,0 +1,434 @@
+/* Copyright 2021 Pants project contributors (see CONTRIBUTORS.md).
+ * Licensed under the Apache License, Version 2.0 (see LICENSE).
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/build"
+	"go/token"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// boolPtr is a small helper for building Platform literals with an explicit CgoEnabled value.
+func boolPtr(b bool) *bool { return &b }
+
+// TestBuildContextForPlatformZeroValueInheritsDefaults verifies that the zero-value Platform{} -
+// what loadPlatforms returns when --platforms is omitted - leaves build.Default's CgoEnabled and
+// BuildTags untouched, matching the "zero value means the host platform" doc comment on Platform.
+func TestBuildContextForPlatformZeroValueInheritsDefaults(t *testing.T) {
+	buildContext := buildContextForPlatform(Platform{})
+
+	if buildContext.GOOS != build.Default.GOOS {
+		t.Errorf("GOOS = %q, want build.Default.GOOS %q", buildContext.GOOS, build.Default.GOOS)
+	}
+	if buildContext.GOARCH != build.Default.GOARCH {
+		t.Errorf("GOARCH = %q, want build.Default.GOARCH %q", buildContext.GOARCH, build.Default.GOARCH)
+	}
+	if buildContext.CgoEnabled != build.Default.CgoEnabled {
+		t.Errorf("CgoEnabled = %v, want build.Default.CgoEnabled %v", buildContext.CgoEnabled, build.Default.CgoEnabled)
+	}
+	if len(buildContext.BuildTags) != len(build.Default.BuildTags) {
+		t.Errorf("BuildTags = %v, want build.Default.BuildTags %v", buildContext.BuildTags, build.Default.BuildTags)
+	}
+}
+
+// TestBuildContextForPlatformExplicitOverrides verifies that explicitly set fields on Platform do
+// override build.Default, including an explicit request to disable cgo.
+func TestBuildContextForPlatformExplicitOverrides(t *testing.T) {
+	platform := Platform{
+		GOOS:       "linux",
+		GOARCH:     "arm64",
+		BuildTags:  []string{"foo", "bar"},
+		CgoEnabled: boolPtr(false),
+	}
+	buildContext := buildContextForPlatform(platform)
+
+	if buildContext.GOOS != "linux" {
+		t.Errorf("GOOS = %q, want %q", buildContext.GOOS, "linux")
+	}
+	if buildContext.GOARCH != "arm64" {
+		t.Errorf("GOARCH = %q, want %q", buildContext.GOARCH, "arm64")
+	}
+	if buildContext.CgoEnabled {
+		t.Errorf("CgoEnabled = true, want false")
+	}
+	if len(buildContext.BuildTags) != 2 || buildContext.BuildTags[0] != "foo" || buildContext.BuildTags[1] != "bar" {
+		t.Errorf("BuildTags = %v, want [foo bar]", buildContext.BuildTags)
+	}
+}
+
+// TestAnalyzeForPlatformsRejectsDuplicateKeys verifies that two requested platforms resolving to
+// the same platformKey (here, two zero-value Platform{} entries, the exact shape the CgoEnabled
+// default bug went unnoticed under) produce an error instead of one silently overwriting the other.
+func TestAnalyzeForPlatformsRejectsDuplicateKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeTestPackage(t, dir, 1)
+
+	_, err := analyzeForPlatforms(dir, "", []Platform{{}, {}}, false, 1)
+	if err == nil {
+		t.Fatal("expected an error for duplicate platform keys, got nil")
+	}
+}
+
+// writeTestPackage populates dir with n trivial, buildable .go files (every tenth of which carries
+// a //go:build constraint, to exercise the concurrent readBuildConstraint path) and returns the
+// directory entries in the same order os.ReadDir would.
+func writeTestPackage(t testing.TB, dir string, n int) []os.DirEntry {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("file%03d.go", i)
+		contents := fmt.Sprintf("package p\n\nvar V%d = %d\n", i, i)
+		if i%10 == 0 {
+			contents = "//go:build linux\n\n" + contents
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory %s: %s", dir, err)
+	}
+	return entries
+}
+
+// TestMatchAndAnalyzeFilesOrdering verifies that, regardless of how many worker goroutines race to
+// process entries, matchAndAnalyzeFiles returns results in the same order as the entries it was
+// given, and that the merged allTags set does not depend on scheduling order.
+func TestMatchAndAnalyzeFilesOrdering(t *testing.T) {
+	dir := t.TempDir()
+	entries := writeTestPackage(t, dir, 64)
+	buildContext := build.Default
+
+	serialTags := make(map[string]bool)
+	fileSet := token.NewFileSet()
+	serial := matchAndAnalyzeFiles(dir, entries, &buildContext, serialTags, fileSet, 1)
+
+	for _, jobs := range []int{2, 8, 32} {
+		parallelTags := make(map[string]bool)
+		parallelResults := matchAndAnalyzeFiles(dir, entries, &buildContext, parallelTags, token.NewFileSet(), jobs)
+
+		if len(parallelResults) != len(serial) {
+			t.Fatalf("jobs=%d: got %d results, want %d", jobs, len(parallelResults), len(serial))
+		}
+		for i, entry := range entries {
+			if parallelResults[i].name != entry.Name() {
+				t.Fatalf("jobs=%d: result[%d].name = %q, want %q (entries out of order)", jobs, i, parallelResults[i].name, entry.Name())
+			}
+			if parallelResults[i].buildConstraint != serial[i].buildConstraint {
+				t.Errorf("jobs=%d: result[%d].buildConstraint = %q, want %q", jobs, i, parallelResults[i].buildConstraint, serial[i].buildConstraint)
+			}
+		}
+		sameTags := len(parallelTags) == len(serialTags)
+		for tag := range serialTags {
+			if !parallelTags[tag] {
+				sameTags = false
+			}
+		}
+		if !sameTags {
+			t.Errorf("jobs=%d: merged allTags = %v, want %v", jobs, parallelTags, serialTags)
+		}
+	}
+}
+
+// TestMatchAndAnalyzeFilesNoDataRace exercises matchAndAnalyzeFiles with many workers sharing a
+// single token.FileSet and allTags map; run with `go test -race` to catch any unsynchronized access.
+func TestMatchAndAnalyzeFilesNoDataRace(t *testing.T) {
+	dir := t.TempDir()
+	entries := writeTestPackage(t, dir, 128)
+	buildContext := build.Default
+	fileSet := token.NewFileSet()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			allTags := make(map[string]bool)
+			matchAndAnalyzeFiles(dir, entries, &buildContext, allTags, fileSet, 16)
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkMatchAndAnalyzeFiles demonstrates scaling on a package-sized directory (500+ files), as
+// requested for the --jobs worker pool added alongside it.
+func BenchmarkMatchAndAnalyzeFiles(b *testing.B) {
+	dir := b.TempDir()
+	entries := writeTestPackage(b, dir, 512)
+	buildContext := build.Default
+
+	for _, jobs := range []int{1, 4, 16} {
+		jobs := jobs
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				allTags := make(map[string]bool)
+				matchAndAnalyzeFiles(dir, entries, &buildContext, allTags, token.NewFileSet(), jobs)
+			}
+		})
+	}
+}
+
+// TestFindCgoToolLocatesHostTool verifies that findCgoTool resolves to a binary that actually
+// exists, keyed by the host GOOS/GOARCH rather than whatever the build context targets.
+func TestFindCgoToolLocatesHostTool(t *testing.T) {
+	buildContext := build.Default
+	buildContext.GOOS = "js"
+	buildContext.GOARCH = "wasm"
+
+	tool, err := findCgoTool(&buildContext)
+	if err != nil {
+		t.Fatalf("findCgoTool: %s", err)
+	}
+	if _, err := os.Stat(tool); err != nil {
+		t.Fatalf("resolved cgo tool %q does not exist: %s", tool, err)
+	}
+	wantSuffix := filepath.Join(runtime.GOOS+"_"+runtime.GOARCH, "cgo")
+	if !strings.HasSuffix(tool, wantSuffix) {
+		t.Errorf("findCgoTool = %q, want a path ending in %q (host platform, not js_wasm)", tool, wantSuffix)
+	}
+}
+
+// TestRunCgoPreprocessing exercises the actual cgo-preprocessing pipeline: it shells out to the
+// real `cgo` tool on a minimal CgoFile, and checks that the resulting CompiledGoFiles are valid Go
+// source and that reapPendingCgoObjDirs subsequently removes the temp directory they live in.
+func TestRunCgoPreprocessing(t *testing.T) {
+	dir := t.TempDir()
+	cgoFile := "cgo_file.go"
+	contents := `package p
+
+/*
+int pantsAdd(int a, int b) { return a + b; }
+*/
+import "C"
+
+func Add(a, b int) int {
+	return int(C.pantsAdd(C.int(a), C.int(b)))
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, cgoFile), []byte(contents), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %s", cgoFile, err)
+	}
+
+	buildContext := build.Default
+	compiledGoFiles, err := runCgoPreprocessing(dir, []string{cgoFile}, &buildContext)
+	if err != nil {
+		t.Fatalf("runCgoPreprocessing: %s", err)
+	}
+	if len(compiledGoFiles) == 0 {
+		t.Fatal("runCgoPreprocessing returned no CompiledGoFiles")
+	}
+
+	fileSet := token.NewFileSet()
+	for _, f := range compiledGoFiles {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("CompiledGoFile %q does not exist: %s", f, err)
+		}
+		if analysis, err := analyzeFile(fileSet, f); err != nil || analysis.parseErr != nil {
+			t.Errorf("CompiledGoFile %q failed to parse: err=%v parseErr=%v", f, err, analysis.parseErr)
+		}
+	}
+
+	objDir := filepath.Dir(compiledGoFiles[0])
+	reapPendingCgoObjDirs()
+	if _, err := os.Stat(objDir); !os.IsNotExist(err) {
+		t.Errorf("reapPendingCgoObjDirs left %q behind: %v", objDir, err)
+	}
+}
+
+// TestEvaluateBuildConstraint covers EvaluateBuildConstraint's GOOS and explicit tags as well as
+// the implicit "unix" tag that go/build's own matching understands.
+func TestEvaluateBuildConstraint(t *testing.T) {
+	cases := []struct {
+		name   string
+		expr   string
+		goos   string
+		goarch string
+		tags   []string
+		want   bool
+	}{
+		{name: "empty expr always matches", expr: "", goos: "linux", goarch: "amd64", want: true},
+		{name: "goos matches", expr: "linux", goos: "linux", goarch: "amd64", want: true},
+		{name: "goos mismatches", expr: "windows", goos: "linux", goarch: "amd64", want: false},
+		{name: "custom tag matches", expr: "foo", goos: "linux", goarch: "amd64", tags: []string{"foo"}, want: true},
+		{name: "custom tag missing", expr: "foo", goos: "linux", goarch: "amd64", want: false},
+		{name: "implicit unix tag matches linux", expr: "unix", goos: "linux", goarch: "amd64", want: true},
+		{name: "implicit unix tag excludes windows", expr: "unix", goos: "windows", goarch: "amd64", want: false},
+		{name: "negation", expr: "!windows", goos: "linux", goarch: "amd64", want: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := EvaluateBuildConstraint(tc.expr, tc.goos, tc.goarch, tc.tags)
+			if err != nil {
+				t.Fatalf("EvaluateBuildConstraint: %s", err)
+			}
+			if got != tc.want {
+				t.Errorf("EvaluateBuildConstraint(%q, %q, %q, %v) = %v, want %v", tc.expr, tc.goos, tc.goarch, tc.tags, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateBuildConstraintInvalidExpr(t *testing.T) {
+	if _, err := EvaluateBuildConstraint("(", "linux", "amd64", nil); err == nil {
+		t.Fatal("expected an error for a malformed //go:build expression, got nil")
+	}
+}
+
+// TestEvaluateConstraintQuery covers the --stdin "?"-prefixed request variant that makes
+// EvaluateBuildConstraint reachable from the process that invokes this binary as a subprocess.
+func TestEvaluateConstraintQuery(t *testing.T) {
+	raw := evaluateConstraintQuery(`{"Expr":"linux","GOOS":"linux","GOARCH":"amd64"}`)
+
+	var result constraintQueryResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		t.Fatalf("failed to decode constraintQueryResult: %s (raw: %s)", err, raw)
+	}
+	if result.Error != "" {
+		t.Fatalf("unexpected error: %s", result.Error)
+	}
+	if !result.Matches {
+		t.Errorf("Matches = false, want true")
+	}
+}
+
+func TestEvaluateConstraintQueryMalformed(t *testing.T) {
+	raw := evaluateConstraintQuery(`not json`)
+
+	var result constraintQueryResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		t.Fatalf("failed to decode constraintQueryResult: %s (raw: %s)", err, raw)
+	}
+	if result.Error == "" {
+		t.Errorf("expected a non-empty Error for a malformed query, got none (raw: %s)", raw)
+	}
+}
+
+// TestAnalyzePackageImportPositions covers Package.ImportPositions: the file/line/column of each
+// import occurrence, plus the doc comment attached to it (e.g. a canonical import path override).
+func TestAnalyzePackageImportPositions(t *testing.T) {
+	dir := t.TempDir()
+	contents := `package p
+
+import (
+	// fmt is used for formatting.
+	"fmt"
+
+	"os"
+)
+
+var _ = fmt.Sprint
+var _ = os.Open
+`
+	if err := os.WriteFile(filepath.Join(dir, "p.go"), []byte(contents), 0o644); err != nil {
+		t.Fatalf("failed to write p.go: %s", err)
+	}
+
+	buildContext := build.Default
+	pkg, err := analyzePackage(dir, &buildContext, "", false, 1)
+	if err != nil {
+		t.Fatalf("analyzePackage: %s", err)
+	}
+
+	fmtPositions := pkg.ImportPositions["fmt"]
+	if len(fmtPositions) != 1 {
+		t.Fatalf(`ImportPositions["fmt"] = %+v, want exactly one entry`, fmtPositions)
+	}
+	if fmtPositions[0].File != "p.go" || fmtPositions[0].Line != 5 {
+		t.Errorf(`ImportPositions["fmt"][0] = %+v, want File "p.go" Line 5`, fmtPositions[0])
+	}
+	if fmtPositions[0].Doc != "fmt is used for formatting." {
+		t.Errorf(`ImportPositions["fmt"][0].Doc = %q, want %q`, fmtPositions[0].Doc, "fmt is used for formatting.")
+	}
+
+	osPositions := pkg.ImportPositions["os"]
+	if len(osPositions) != 1 {
+		t.Fatalf(`ImportPositions["os"] = %+v, want exactly one entry`, osPositions)
+	}
+	if osPositions[0].Doc != "" {
+		t.Errorf(`ImportPositions["os"][0].Doc = %q, want ""`, osPositions[0].Doc)
+	}
+}
+
+// TestAnalyzePackageImportCommentExpectedMismatch covers the error path added for
+// expectedImportPath: a `// import "path"` comment that disagrees with the import path the
+// directory was analyzed under is reported via InvalidGoFiles, matching `go build`'s behavior.
+func TestAnalyzePackageImportCommentExpectedMismatch(t *testing.T) {
+	dir := t.TempDir()
+	contents := "package p // import \"canonical/path\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "p.go"), []byte(contents), 0o644); err != nil {
+		t.Fatalf("failed to write p.go: %s", err)
+	}
+
+	buildContext := build.Default
+	// The directory has no other buildable files once p.go is rejected for the mismatch, so
+	// analyzePackage itself returns a "no buildable Go source files" error alongside the partial
+	// Package; the mismatch is recorded in InvalidGoFiles regardless.
+	pkg, _ := analyzePackage(dir, &buildContext, "other/path", false, 1)
+
+	if pkg.ImportComment != "canonical/path" {
+		t.Errorf("ImportComment = %q, want %q", pkg.ImportComment, "canonical/path")
+	}
+	if msg := pkg.InvalidGoFiles["p.go"]; !strings.Contains(msg, "other/path") {
+		t.Errorf("InvalidGoFiles[%q] = %q, want a message mentioning the expected import path %q", "p.go", msg, "other/path")
+	}
+}
+
+// TestAnalyzePackageImportCommentDisagreement covers the error path for two source files in the
+// same directory that declare disagreeing `// import "path"` comments.
+func TestAnalyzePackageImportCommentDisagreement(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.go": "package p // import \"path/one\"\n",
+		"b.go": "package p // import \"path/two\"\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %s", name, err)
+		}
+	}
+
+	buildContext := build.Default
+	pkg, err := analyzePackage(dir, &buildContext, "", false, 1)
+	if err != nil {
+		t.Fatalf("analyzePackage: %s", err)
+	}
+
+	if pkg.ImportComment != "path/one" {
+		t.Errorf("ImportComment = %q, want %q (first file processed wins)", pkg.ImportComment, "path/one")
+	}
+	if msg := pkg.InvalidGoFiles["b.go"]; !strings.Contains(msg, "path/one") || !strings.Contains(msg, "path/two") {
+		t.Errorf("InvalidGoFiles[%q] = %q, want a message mentioning both disagreeing import comments", "b.go", msg)
+	}
+}
+
+// TestAnalyzePackageBinaryOnly covers Package.BinaryOnly: a `//go:binary-only-package` comment on
+// any file in the directory marks the whole package as binary-only.
+func TestAnalyzePackageBinaryOnly(t *testing.T) {
+	dir := t.TempDir()
+	contents := "//go:binary-only-package\n\npackage p\n"
+	if err := os.WriteFile(filepath.Join(dir, "p.go"), []byte(contents), 0o644); err != nil {
+		t.Fatalf("failed to write p.go: %s", err)
+	}
+
+	buildContext := build.Default
+	pkg, err := analyzePackage(dir, &buildContext, "", false, 1)
+	if err != nil {
+		t.Fatalf("analyzePackage: %s", err)
+	}
+
+	if !pkg.BinaryOnly {
+		t.Error("BinaryOnly = false, want true")
+	}
+}